@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	cmux "github.com/soheilhy/cmux"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// keyInfo is the wire shape of a single installed key, as returned by
+// ListKeys over both gRPC and the HTTP gateway.
+type keyInfo struct {
+	Name      string     `json:"name"`
+	Installed *time.Time `json:"installed,omitempty"`
+	IsDefault bool       `json:"is_default"`
+}
+
+// appliedEvent is streamed to Stream subscribers as each event is applied.
+type appliedEvent struct {
+	Event string    `json:"event"`
+	Name  string    `json:"name,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+type listKeysRequest struct{}
+type listKeysResponse struct {
+	Keys []keyInfo `json:"keys"`
+}
+
+type installKeyRequest struct {
+	Payload []byte `json:"payload"`
+}
+type installKeyResponse struct{}
+
+type removeKeyRequest struct {
+	Name string `json:"name"`
+}
+type removeKeyResponse struct{}
+
+type setDefaultKeyRequest struct {
+	Name string `json:"name"`
+}
+type setDefaultKeyResponse struct{}
+
+type wipeKeysRequest struct{}
+type wipeKeysResponse struct{}
+
+type streamRequest struct{}
+
+// adminNotify, when set, is called after every event processEvent applies
+// successfully, so the admin API can track install times and fan events
+// out to Stream subscribers without processEvent needing to know about it.
+var adminNotify func(event string, payload []byte)
+
+func notifyAdmin(event string, payload []byte) {
+	if adminNotify != nil {
+		adminNotify(event, payload)
+	}
+}
+
+// adminServer implements the admin control plane: ListKeys, InstallKey,
+// RemoveKey, SetDefaultKey, WipeKeys, and a streaming feed of applied
+// events. Every mutating method synthesises the serf event name a WAN
+// gossip message of the same kind would carry and hands the plain,
+// unsigned body to process, which is main's processEvent bound to treat
+// the call as locally trusted: it skips eventAuth.Verify (there's no way
+// for an admin caller to produce the internal HMAC envelope), but still
+// signs the outgoing event before publishing it to both the LAN and the
+// WAN, so other proxies see it exactly as they would a gossiped change.
+type adminServer struct {
+	prefix  string
+	process func(name string, payload []byte, coalesce bool)
+
+	subsMut sync.Mutex
+	subs    map[chan appliedEvent]struct{}
+
+	timesMut     sync.Mutex
+	installTimes map[string]time.Time
+}
+
+func newAdminServer(prefix string, process func(name string, payload []byte, coalesce bool)) *adminServer {
+	a := &adminServer{
+		prefix:       prefix,
+		process:      process,
+		subs:         make(map[chan appliedEvent]struct{}),
+		installTimes: make(map[string]time.Time),
+	}
+
+	adminNotify = a.notify
+	return a
+}
+
+func (a *adminServer) notify(event string, payload []byte) {
+	ev := appliedEvent{Event: event, At: time.Now()}
+	if len(payload) >= nameLen {
+		ev.Name = hex.EncodeToString(payload[:nameLen])
+	}
+
+	if event == installKeyEvent {
+		a.timesMut.Lock()
+		a.installTimes[ev.Name] = ev.At
+		a.timesMut.Unlock()
+	}
+
+	a.subsMut.Lock()
+	for ch := range a.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Warnf("admin: stream subscriber too slow, dropping event")
+		}
+	}
+	a.subsMut.Unlock()
+}
+
+// installTime reports when name was installed, or nil if this server has
+// never observed an install for it - e.g. a key loaded from the WAL
+// snapshot or a KV backend bootstrap before this server started tracking
+// installs.
+func (a *adminServer) installTime(name string) *time.Time {
+	a.timesMut.Lock()
+	defer a.timesMut.Unlock()
+
+	t, ok := a.installTimes[name]
+	if !ok {
+		return nil
+	}
+
+	return &t
+}
+
+func (a *adminServer) listKeys(_ context.Context, _ *listKeysRequest) (*listKeysResponse, error) {
+	keysMut.RLock()
+	defer keysMut.RUnlock()
+
+	resp := &listKeysResponse{Keys: make([]keyInfo, len(keys))}
+
+	for i, key := range keys {
+		name := hex.EncodeToString(key[:nameLen])
+
+		resp.Keys[i] = keyInfo{
+			Name:      name,
+			Installed: a.installTime(name),
+			IsDefault: defaultKey != nil && bytes.Equal((*defaultKey)[:nameLen], key[:nameLen]),
+		}
+	}
+
+	return resp, nil
+}
+
+func (a *adminServer) installKey(_ context.Context, req *installKeyRequest) (*installKeyResponse, error) {
+	if len(req.Payload) <= nameLen {
+		return nil, status.Error(codes.InvalidArgument, "payload too short")
+	}
+
+	a.process(a.prefix+installKeyEvent, req.Payload, false)
+	return &installKeyResponse{}, nil
+}
+
+func (a *adminServer) removeKey(_ context.Context, req *removeKeyRequest) (*removeKeyResponse, error) {
+	name, err := hex.DecodeString(req.Name)
+	if err != nil || len(name) != nameLen {
+		return nil, status.Error(codes.InvalidArgument, "invalid key name")
+	}
+
+	a.process(a.prefix+removeKeyEvent, name, false)
+	return &removeKeyResponse{}, nil
+}
+
+func (a *adminServer) setDefaultKey(_ context.Context, req *setDefaultKeyRequest) (*setDefaultKeyResponse, error) {
+	name, err := hex.DecodeString(req.Name)
+	if err != nil || len(name) != nameLen {
+		return nil, status.Error(codes.InvalidArgument, "invalid key name")
+	}
+
+	a.process(a.prefix+setDefaultKeyEvent, name, false)
+	return &setDefaultKeyResponse{}, nil
+}
+
+func (a *adminServer) wipeKeys(_ context.Context, _ *wipeKeysRequest) (*wipeKeysResponse, error) {
+	a.process(a.prefix+wipeKeysEvent, nil, false)
+	return &wipeKeysResponse{}, nil
+}
+
+func (a *adminServer) stream(stream grpc.ServerStream) error {
+	ch := make(chan appliedEvent, 16)
+
+	a.subsMut.Lock()
+	a.subs[ch] = struct{}{}
+	a.subsMut.Unlock()
+
+	defer func() {
+		a.subsMut.Lock()
+		delete(a.subs, ch)
+		a.subsMut.Unlock()
+	}()
+
+	for {
+		select {
+		case ev := <-ch:
+			if err := stream.SendMsg(&ev); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// jsonCodec is a gRPC wire codec that encodes messages as JSON instead of
+// protobuf, so the admin service's request/response types can be plain Go
+// structs without a protoc-generated package.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+// unaryHandler adapts a typed adminServer method to the untyped
+// grpc.MethodDesc.Handler shape, in place of what protoc-gen-go-grpc would
+// otherwise generate.
+func unaryHandler[Req, Resp any](method string, fn func(*adminServer, context.Context, *Req) (*Resp, error)) func(interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		a := srv.(*adminServer)
+
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+
+		if interceptor == nil {
+			return fn(a, ctx, req)
+		}
+
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: method}
+		handler := func(ctx context.Context, r interface{}) (interface{}, error) {
+			return fn(a, ctx, r.(*Req))
+		}
+
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+var adminServiceDesc = grpc.ServiceDesc{
+	ServiceName: "etherkeyproxy.AdminService",
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "ListKeys", Handler: unaryHandler("/etherkeyproxy.AdminService/ListKeys", (*adminServer).listKeys)},
+		{MethodName: "InstallKey", Handler: unaryHandler("/etherkeyproxy.AdminService/InstallKey", (*adminServer).installKey)},
+		{MethodName: "RemoveKey", Handler: unaryHandler("/etherkeyproxy.AdminService/RemoveKey", (*adminServer).removeKey)},
+		{MethodName: "SetDefaultKey", Handler: unaryHandler("/etherkeyproxy.AdminService/SetDefaultKey", (*adminServer).setDefaultKey)},
+		{MethodName: "WipeKeys", Handler: unaryHandler("/etherkeyproxy.AdminService/WipeKeys", (*adminServer).wipeKeys)},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Stream",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				var req streamRequest
+				if err := stream.RecvMsg(&req); err != nil {
+					return err
+				}
+
+				return srv.(*adminServer).stream(stream)
+			},
+			ServerStreams: true,
+		},
+	},
+}
+
+func loadAdminToken(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+func checkBearerToken(token, header string) error {
+	if token == "" {
+		return nil
+	}
+
+	got := strings.TrimPrefix(header, "Bearer ")
+	if header == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		return status.Error(codes.Unauthenticated, "missing or invalid bearer token")
+	}
+
+	return nil
+}
+
+func (a *adminServer) unaryAuth(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+
+		var header string
+		if vs := md.Get("authorization"); len(vs) == 1 {
+			header = vs[0]
+		}
+
+		if err := checkBearerToken(token, header); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func (a *adminServer) streamAuth(token string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		md, _ := metadata.FromIncomingContext(ss.Context())
+
+		var header string
+		if vs := md.Get("authorization"); len(vs) == 1 {
+			header = vs[0]
+		}
+
+		if err := checkBearerToken(token, header); err != nil {
+			return err
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// httpHandler serves the JSON-over-HTTP gateway, calling the same typed
+// methods the gRPC service does.
+func (a *adminServer) httpHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+
+	jsonMethod := func(fn func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := checkBearerToken(token, r.Header.Get("Authorization")); err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			resp, err := fn(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+		}
+	}
+
+	mux.HandleFunc("/v1/keys", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			jsonMethod(func(*http.Request) (interface{}, error) {
+				return a.listKeys(r.Context(), &listKeysRequest{})
+			})(w, r)
+		case http.MethodPost:
+			jsonMethod(func(r *http.Request) (interface{}, error) {
+				var req installKeyRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					return nil, err
+				}
+
+				return a.installKey(r.Context(), &req)
+			})(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/v1/keys/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/v1/keys/")
+
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		jsonMethod(func(*http.Request) (interface{}, error) {
+			return a.removeKey(r.Context(), &removeKeyRequest{Name: name})
+		})(w, r)
+	})
+
+	mux.HandleFunc("/v1/default/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/v1/default/")
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		jsonMethod(func(*http.Request) (interface{}, error) {
+			return a.setDefaultKey(r.Context(), &setDefaultKeyRequest{Name: name})
+		})(w, r)
+	})
+
+	mux.HandleFunc("/v1/wipe", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		jsonMethod(func(*http.Request) (interface{}, error) {
+			return a.wipeKeys(r.Context(), &wipeKeysRequest{})
+		})(w, r)
+	})
+
+	mux.HandleFunc("/v1/stream", func(w http.ResponseWriter, r *http.Request) {
+		if err := checkBearerToken(token, r.Header.Get("Authorization")); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		ch := make(chan appliedEvent, 16)
+		a.subsMut.Lock()
+		a.subs[ch] = struct{}{}
+		a.subsMut.Unlock()
+
+		defer func() {
+			a.subsMut.Lock()
+			delete(a.subs, ch)
+			a.subsMut.Unlock()
+		}()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+
+		for {
+			select {
+			case ev := <-ch:
+				if err := enc.Encode(ev); err != nil {
+					return
+				}
+
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+
+	return mux
+}
+
+// Serve runs the admin API on addr until the process exits, offering gRPC
+// (with reflection) and the JSON-over-HTTP gateway on the same port,
+// optionally behind TLS/mTLS.
+func (a *adminServer) Serve(addr, tokenFile, tlsCert, tlsKey, clientCA string) {
+	token, err := loadAdminToken(tokenFile)
+	if err != nil {
+		panic(err)
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		panic(err)
+	}
+
+	if tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			panic(err)
+		}
+
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+		if clientCA != "" {
+			caData, err := os.ReadFile(clientCA)
+			if err != nil {
+				panic(err)
+			}
+
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caData) {
+				panic(fmt.Errorf("admin: no certificates found in -admin-client-ca %q", clientCA))
+			}
+
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+
+	m := cmux.New(lis)
+	grpcLis := m.MatchWithWriters(cmux.HTTP2MatchHeaderFieldPrefixSendSettings("content-type", "application/grpc"))
+	httpLis := m.Match(cmux.HTTP1Fast(), cmux.HTTP2())
+
+	grpcServer := grpc.NewServer(
+		grpc.ForceServerCodec(jsonCodec{}),
+		grpc.UnaryInterceptor(a.unaryAuth(token)),
+		grpc.StreamInterceptor(a.streamAuth(token)),
+	)
+	grpcServer.RegisterService(&adminServiceDesc, a)
+	reflection.Register(grpcServer)
+
+	httpServer := &http.Server{Handler: a.httpHandler(token)}
+
+	go grpcServer.Serve(grpcLis)
+	go httpServer.Serve(httpLis)
+
+	log.Infof("admin: serving gRPC/HTTP on %s", addr)
+
+	if err := m.Serve(); err != nil {
+		log.Errorf("admin: serve error: %v", err)
+	}
+}
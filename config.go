@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	hjson "github.com/hjson/hjson-go/v4"
+	serf "github.com/hashicorp/serf/client"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Duration is a time.Duration that (un)marshals as the same string form as
+// the matching -event-hmac-skew flag (e.g. "5m"), instead of json/yaml's
+// default bare-int64-nanoseconds encoding of time.Duration, so a config
+// file and the flag it mirrors don't silently disagree on the same value.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(dur)
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(dur)
+	return nil
+}
+
+// Config mirrors the full set of settings main accepts as flags, so that a
+// deployment can check a single file into revision control instead of
+// templating a systemd unit's argv. Every field here has a matching flag;
+// flags take precedence when both are given.
+type Config struct {
+	Wan serf.Config `json:"wan" yaml:"wan"`
+	Lan serf.Config `json:"lan" yaml:"lan"`
+
+	Prefix   string `json:"prefix" yaml:"prefix"`
+	StateDir string `json:"state-dir" yaml:"state-dir"`
+
+	KVBackend string `json:"kv-backend" yaml:"kv-backend"`
+	KVPrefix  string `json:"kv-prefix" yaml:"kv-prefix"`
+	KVSecret  string `json:"kv-secret" yaml:"kv-secret"`
+
+	EventHMACKey      string   `json:"event-hmac-key" yaml:"event-hmac-key"`
+	EventHMACKeyFile  string   `json:"event-hmac-key-file" yaml:"event-hmac-key-file"`
+	EventHMACSkew     Duration `json:"event-hmac-skew" yaml:"event-hmac-skew"`
+	EventHMACRequired bool     `json:"event-hmac-required" yaml:"event-hmac-required"`
+
+	AdminAddr      string `json:"admin-addr" yaml:"admin-addr"`
+	AdminTokenFile string `json:"admin-token-file" yaml:"admin-token-file"`
+	AdminTLSCert   string `json:"admin-tls-cert" yaml:"admin-tls-cert"`
+	AdminTLSKey    string `json:"admin-tls-key" yaml:"admin-tls-key"`
+	AdminClientCA  string `json:"admin-client-ca" yaml:"admin-client-ca"`
+
+	MetricsAddr string `json:"metrics-addr" yaml:"metrics-addr"`
+	LogSyslog   bool   `json:"log-syslog" yaml:"log-syslog"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Wan: serf.Config{Addr: "127.0.0.1:7374"},
+		Lan: serf.Config{Addr: "127.0.0.1:7373"},
+
+		Prefix:   "ether:",
+		KVPrefix: "ether/keys/",
+
+		EventHMACSkew: Duration(5 * time.Minute),
+	}
+}
+
+// configPathFromArgs scans argv for a -config/--config flag ahead of the
+// normal flag.Parse call, so its value can be used to seed the defaults of
+// every other flag before they're registered.
+func configPathFromArgs(args []string) string {
+	for i, arg := range args {
+		switch {
+		case arg == "-config" || arg == "--config":
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+		case strings.HasPrefix(arg, "-config="):
+			return strings.TrimPrefix(arg, "-config=")
+		case strings.HasPrefix(arg, "--config="):
+			return strings.TrimPrefix(arg, "--config=")
+		}
+	}
+
+	return ""
+}
+
+// hasBoolFlag reports whether a boolean flag (e.g. -normaliseconfig or
+// -normaliseconfig=true) is present in args, without requiring it to be
+// registered with the flag package first.
+func hasBoolFlag(args []string, name string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "-" + name, "--" + name, "-" + name + "=true", "--" + name + "=true":
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeConfig unmarshals data into cfg, auto-detecting HJSON, JSON or YAML
+// from ext (as returned by filepath.Ext), much like yggdrasil's node config
+// loader: .yaml and .yml are read as YAML, while .json, .hjson and no
+// extension at all are read as HJSON - a superset of JSON. Any other
+// extension is rejected with an error.
+func decodeConfig(data []byte, ext string, cfg *Config) error {
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(data, cfg)
+	case ".json", ".hjson", "":
+		return hjson.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("config: unrecognised extension %q", ext)
+	}
+}
+
+// loadConfigFile reads and decodes the config file at path.
+func loadConfigFile(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := decodeConfig(data, filepath.Ext(path), &cfg); err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// normaliseConfig reads an HJSON or JSON config (not YAML) from r and writes
+// its canonical JSON form to w, for migrating old flag-only invocations to
+// a checked-in config file.
+func normaliseConfig(r io.Reader, w io.Writer) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	cfg := defaultConfig()
+	if err := hjson.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(cfg)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	msgpack "github.com/hashicorp/go-msgpack/codec"
+)
+
+// signEventForTest encodes ev as a signed envelope without going through
+// Sign, so tests can construct events with a specific timestamp or nonce
+// that Sign itself never produces.
+func signEventForTest(ev signedEvent) ([]byte, error) {
+	var buf []byte
+	enc := msgpack.NewEncoderBytes(&buf, &msgpack.MsgpackHandle{RawToString: true, WriteExt: true})
+	if err := enc.Encode(ev); err != nil {
+		return nil, err
+	}
+
+	return append([]byte{signedEventMagic}, buf...), nil
+}
+
+func newTestAuthenticator(t *testing.T, required bool) *eventAuthenticator {
+	t.Helper()
+
+	a, err := newEventAuthenticator("test-secret", "", time.Minute, required)
+	if err != nil {
+		t.Fatalf("newEventAuthenticator: %v", err)
+	}
+
+	return a
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	a := newTestAuthenticator(t, true)
+
+	payload, err := a.Sign([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	body, signed, err := a.Verify(payload)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if !signed {
+		t.Fatal("Verify: signed = false, want true")
+	}
+
+	if string(body) != "hello" {
+		t.Fatalf("Verify body = %q, want %q", body, "hello")
+	}
+}
+
+func TestVerifyUnsignedPayload(t *testing.T) {
+	a := newTestAuthenticator(t, false)
+
+	body, signed, err := a.Verify([]byte("plain"))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if signed {
+		t.Fatal("Verify: signed = true, want false")
+	}
+
+	if string(body) != "plain" {
+		t.Fatalf("Verify body = %q, want %q", body, "plain")
+	}
+}
+
+func TestVerifyEmptyPayload(t *testing.T) {
+	a := newTestAuthenticator(t, false)
+
+	body, signed, err := a.Verify(nil)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if signed {
+		t.Fatal("Verify: signed = true, want false")
+	}
+
+	if len(body) != 0 {
+		t.Fatalf("Verify body = %q, want empty", body)
+	}
+}
+
+func TestVerifyTagMismatch(t *testing.T) {
+	a := newTestAuthenticator(t, true)
+
+	payload, err := a.Sign([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	// Flip a byte in the tail of the envelope, inside the Tag field.
+	payload[len(payload)-1] ^= 0xff
+
+	if _, _, err := a.Verify(payload); err == nil {
+		t.Fatal("Verify: err = nil, want tag mismatch")
+	}
+}
+
+func TestVerifyUnknownKeyID(t *testing.T) {
+	a := newTestAuthenticator(t, true)
+
+	// The ring only holds KeyID 0, so an envelope naming KeyID 7 has no
+	// key to check its tag against.
+	var nonce [12]byte
+	ev := signedEvent{
+		KeyID:     7,
+		Nonce:     nonce,
+		Timestamp: time.Now().Unix(),
+		Body:      []byte("hello"),
+	}
+	ev.Tag = eventTag([]byte("test-secret"), ev.KeyID, ev.Nonce, ev.Timestamp, ev.Body)
+
+	payload, err := signEventForTest(ev)
+	if err != nil {
+		t.Fatalf("signEventForTest: %v", err)
+	}
+
+	if _, _, err := a.Verify(payload); err == nil || !strings.Contains(err.Error(), "unknown key id") {
+		t.Fatalf("Verify: err = %v, want unknown key id", err)
+	}
+}
+
+func TestVerifySkewWindow(t *testing.T) {
+	a := newTestAuthenticator(t, true)
+
+	var nonce [12]byte
+	ev := signedEvent{
+		KeyID:     a.activeKeyID,
+		Nonce:     nonce,
+		Timestamp: time.Now().Add(-time.Hour).Unix(),
+		Body:      []byte("hello"),
+	}
+	ev.Tag = eventTag(a.keys[ev.KeyID], ev.KeyID, ev.Nonce, ev.Timestamp, ev.Body)
+
+	payload, err := signEventForTest(ev)
+	if err != nil {
+		t.Fatalf("signEventForTest: %v", err)
+	}
+
+	if _, _, err := a.Verify(payload); err == nil {
+		t.Fatal("Verify: err = nil, want timestamp outside skew window")
+	}
+}
+
+func TestVerifyReplayedNonce(t *testing.T) {
+	a := newTestAuthenticator(t, true)
+
+	payload, err := a.Sign([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	if _, _, err := a.Verify(payload); err != nil {
+		t.Fatalf("first Verify: %v", err)
+	}
+
+	if _, _, err := a.Verify(payload); err == nil {
+		t.Fatal("second Verify: err = nil, want replayed nonce")
+	}
+}
+
+func TestVerifyRequiredRejectsUnsigned(t *testing.T) {
+	a := newTestAuthenticator(t, true)
+
+	body, signed, err := a.Verify([]byte("plain"))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if signed {
+		t.Fatal("Verify: signed = true, want false")
+	}
+
+	if string(body) != "plain" {
+		t.Fatalf("Verify body = %q, want %q", body, "plain")
+	}
+
+	// Verify itself only reports signed=false; it is the caller's
+	// responsibility (processEvent) to reject based on a.required.
+	if !a.required {
+		t.Fatal("required = false, want true")
+	}
+}
+
+func TestLoadKeyRingInlineSecret(t *testing.T) {
+	keys, err := loadKeyRing("my-secret", "")
+	if err != nil {
+		t.Fatalf("loadKeyRing: %v", err)
+	}
+
+	want := map[uint8][]byte{0: []byte("my-secret")}
+	if len(keys) != 1 || string(keys[0]) != string(want[0]) {
+		t.Fatalf("loadKeyRing = %+v, want %+v", keys, want)
+	}
+}
+
+func TestLoadKeyRingInlineSecretWithSlash(t *testing.T) {
+	// A base64-ish secret containing '/' must still be used verbatim,
+	// never misread as a file path.
+	const secret = "YmFzZTY0/c2VjcmV0=="
+
+	keys, err := loadKeyRing(secret, "")
+	if err != nil {
+		t.Fatalf("loadKeyRing: %v", err)
+	}
+
+	if string(keys[0]) != secret {
+		t.Fatalf("loadKeyRing = %+v, want secret %q", keys, secret)
+	}
+}
+
+func TestLoadKeyRingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring")
+	contents := "# comment\n0:aabbccdd\n1:11223344\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	keys, err := loadKeyRing("", path)
+	if err != nil {
+		t.Fatalf("loadKeyRing: %v", err)
+	}
+
+	if len(keys) != 2 {
+		t.Fatalf("loadKeyRing = %+v, want 2 keys", keys)
+	}
+
+	if string(keys[0]) != "\xaa\xbb\xcc\xdd" {
+		t.Fatalf("loadKeyRing[0] = %x, want aabbccdd", keys[0])
+	}
+}
+
+func TestLoadKeyRingMissingFile(t *testing.T) {
+	if _, err := loadKeyRing("", filepath.Join(t.TempDir(), "does-not-exist")); err == nil {
+		t.Fatal("loadKeyRing: err = nil, want read error")
+	}
+}
+
+func TestLoadKeyRingMutuallyExclusive(t *testing.T) {
+	if _, err := loadKeyRing("secret", "/some/path"); err == nil {
+		t.Fatal("loadKeyRing: err = nil, want mutually-exclusive error")
+	}
+}
+
+func TestLoadKeyRingEmptyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring")
+	if err := os.WriteFile(path, []byte("# only comments\n"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if _, err := loadKeyRing("", path); err == nil {
+		t.Fatal("loadKeyRing: err = nil, want no-keys error")
+	}
+}
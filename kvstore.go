@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	kvDefaultMarkerKey = "\x00default"
+	kvLeaseTTL         = 30 * time.Second
+)
+
+// KeyStore is a pluggable backend that can hold the full set of
+// session-ticket keys outside of serf gossip, so a proxy joining a quiet
+// WAN still has somewhere to bootstrap its state from.
+type KeyStore interface {
+	// LoadAll loads every key currently stored under the configured prefix.
+	LoadAll(ctx context.Context) (keySnapshot, error)
+
+	// Watch streams install/remove/set-default changes as they are
+	// written to the backend by other proxies, invoking apply for each
+	// until ctx is cancelled. No wipe event is emitted: a wiped prefix
+	// arrives as one remove per deleted key, and deletion of the default
+	// marker is not reported.
+	Watch(ctx context.Context, apply func(event string, payload []byte))
+
+	// Mirror writes an applied event into the backend, leased so that a
+	// crashed proxy's writes eventually expire instead of leaving stale
+	// entries behind forever.
+	Mirror(ctx context.Context, event string, payload []byte) error
+
+	Close() error
+}
+
+// newKeyStore constructs a KeyStore from a backend URL such as
+// "etcd://host:2379,host2:2379" or "consul://host:8500". secret, if
+// non-empty, must be a valid AES-128/192/256 key used to seal key material
+// before it is written to the backend.
+func newKeyStore(backend, prefix string, secret []byte) (KeyStore, error) {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return nil, fmt.Errorf("kvstore: invalid -kv-backend %q: %w", backend, err)
+	}
+
+	var aead cipher.AEAD
+	if len(secret) > 0 {
+		if aead, err = newAEAD(secret); err != nil {
+			return nil, fmt.Errorf("kvstore: invalid -kv-secret: %w", err)
+		}
+	}
+
+	endpoints := strings.Split(u.Host, ",")
+
+	switch u.Scheme {
+	case "etcd":
+		return newEtcdKeyStore(endpoints, prefix, aead)
+	case "consul":
+		return newConsulKeyStore(u.Host, prefix, aead)
+	default:
+		return nil, fmt.Errorf("kvstore: unknown -kv-backend scheme %q", u.Scheme)
+	}
+}
+
+func newAEAD(secret []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte) []byte {
+	if aead == nil {
+		return plaintext
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil)
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if aead == nil {
+		return sealed, nil
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("kvstore: sealed value shorter than nonce")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// kvKeyName returns the backend key under prefix for a given key name. It
+// never returns the default-key marker; callers build that key themselves
+// as prefix+kvDefaultMarkerKey.
+func kvKeyName(prefix string, name []byte) string {
+	return prefix + hex.EncodeToString(name)
+}
+
+// etcdKeyStore implements KeyStore on top of etcd's v3 client.
+type etcdKeyStore struct {
+	cli     *clientv3.Client
+	prefix  string
+	aead    cipher.AEAD
+	leaseID clientv3.LeaseID
+}
+
+func newEtcdKeyStore(endpoints []string, prefix string, aead cipher.AEAD) (*etcdKeyStore, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &etcdKeyStore{cli: cli, prefix: prefix, aead: aead}
+
+	if err := ks.acquireLease(context.Background()); err != nil {
+		cli.Close()
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+func (ks *etcdKeyStore) acquireLease(ctx context.Context) error {
+	lease, err := ks.cli.Grant(ctx, int64(kvLeaseTTL.Seconds()))
+	if err != nil {
+		return err
+	}
+
+	keepAlive, err := ks.cli.KeepAlive(context.Background(), lease.ID)
+	if err != nil {
+		return err
+	}
+
+	ks.leaseID = lease.ID
+
+	go func() {
+		for range keepAlive {
+		}
+
+		log.Warnf("kvstore: etcd lease %x expired, keys written by this proxy will be reaped", lease.ID)
+	}()
+
+	return nil
+}
+
+func (ks *etcdKeyStore) LoadAll(ctx context.Context) (keySnapshot, error) {
+	resp, err := ks.cli.Get(ctx, ks.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return keySnapshot{}, err
+	}
+
+	var snap keySnapshot
+
+	for _, kv := range resp.Kvs {
+		plain, err := open(ks.aead, kv.Value)
+		if err != nil {
+			return keySnapshot{}, err
+		}
+
+		if strings.HasSuffix(string(kv.Key), kvDefaultMarkerKey) {
+			snap.Default = plain
+			continue
+		}
+
+		snap.Keys = append(snap.Keys, plain)
+	}
+
+	return snap, nil
+}
+
+func (ks *etcdKeyStore) Watch(ctx context.Context, apply func(event string, payload []byte)) {
+	for resp := range ks.cli.Watch(ctx, ks.prefix, clientv3.WithPrefix()) {
+		for _, ev := range resp.Events {
+			isDefault := strings.HasSuffix(string(ev.Kv.Key), kvDefaultMarkerKey)
+
+			switch {
+			case ev.Type == clientv3.EventTypePut && isDefault:
+				if plain, err := open(ks.aead, ev.Kv.Value); err != nil {
+					log.Errorf("kvstore: failed to decrypt default marker: %v", err)
+				} else {
+					apply(setDefaultKeyEvent, plain)
+				}
+			case ev.Type == clientv3.EventTypePut:
+				if plain, err := open(ks.aead, ev.Kv.Value); err != nil {
+					log.Errorf("kvstore: failed to decrypt key: %v", err)
+				} else {
+					apply(installKeyEvent, plain)
+				}
+			case ev.Type == clientv3.EventTypeDelete && !isDefault:
+				name, err := hex.DecodeString(strings.TrimPrefix(string(ev.Kv.Key), ks.prefix))
+				if err != nil {
+					log.Errorf("kvstore: failed to decode deleted key name: %v", err)
+					continue
+				}
+
+				apply(removeKeyEvent, name)
+			}
+		}
+	}
+}
+
+func (ks *etcdKeyStore) Mirror(ctx context.Context, event string, payload []byte) error {
+	switch event {
+	case installKeyEvent:
+		_, err := ks.cli.Put(ctx, kvKeyName(ks.prefix, payload[:nameLen]), string(seal(ks.aead, payload)), clientv3.WithLease(ks.leaseID))
+		return err
+	case removeKeyEvent:
+		_, err := ks.cli.Delete(ctx, kvKeyName(ks.prefix, payload))
+		return err
+	case setDefaultKeyEvent:
+		_, err := ks.cli.Put(ctx, ks.prefix+kvDefaultMarkerKey, string(seal(ks.aead, payload)), clientv3.WithLease(ks.leaseID))
+		return err
+	case wipeKeysEvent:
+		_, err := ks.cli.Delete(ctx, ks.prefix, clientv3.WithPrefix())
+		return err
+	default:
+		return nil
+	}
+}
+
+func (ks *etcdKeyStore) Close() error {
+	return ks.cli.Close()
+}
+
+// consulKeyStore implements KeyStore on top of Consul's KV store, tying
+// every write to a session with delete-on-expire behaviour so a crashed
+// proxy's entries are reaped automatically.
+type consulKeyStore struct {
+	cli       *consulapi.Client
+	prefix    string
+	aead      cipher.AEAD
+	sessionID string
+}
+
+func newConsulKeyStore(addr, prefix string, aead cipher.AEAD) (*consulKeyStore, error) {
+	cli, err := consulapi.NewClient(&consulapi.Config{Address: addr})
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &consulKeyStore{cli: cli, prefix: prefix, aead: aead}
+
+	if err := ks.createSession(); err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+func (ks *consulKeyStore) createSession() error {
+	id, _, err := ks.cli.Session().Create(&consulapi.SessionEntry{
+		TTL:      kvLeaseTTL.String(),
+		Behavior: consulapi.SessionBehaviorDelete,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	ks.sessionID = id
+
+	doneCh := make(chan struct{})
+	go func() {
+		if err := ks.cli.Session().RenewPeriodic(kvLeaseTTL.String(), id, nil, doneCh); err != nil {
+			log.Warnf("kvstore: consul session %s renewal stopped: %v", id, err)
+		}
+	}()
+
+	return nil
+}
+
+func (ks *consulKeyStore) LoadAll(ctx context.Context) (keySnapshot, error) {
+	pairs, _, err := ks.cli.KV().List(ks.prefix, nil)
+	if err != nil {
+		return keySnapshot{}, err
+	}
+
+	var snap keySnapshot
+
+	for _, pair := range pairs {
+		plain, err := open(ks.aead, pair.Value)
+		if err != nil {
+			return keySnapshot{}, err
+		}
+
+		if strings.HasSuffix(pair.Key, kvDefaultMarkerKey) {
+			snap.Default = plain
+			continue
+		}
+
+		snap.Keys = append(snap.Keys, plain)
+	}
+
+	return snap, nil
+}
+
+// Watch polls Consul's blocking query API, since Consul (unlike etcd) has
+// no native watch stream. A blocking List returns the full current key set
+// whenever WaitTime elapses with nothing changed, and also whenever *any*
+// key under the prefix changes - not just the ones apply hasn't seen yet -
+// so apply is only called for pairs whose ModifyIndex has actually moved
+// since the last poll, with removals noticed by diffing the seen key set.
+func (ks *consulKeyStore) Watch(ctx context.Context, apply func(event string, payload []byte)) {
+	var lastIndex uint64
+	seen := make(map[string]uint64)
+
+	for ctx.Err() == nil {
+		pairs, meta, err := ks.cli.KV().List(ks.prefix, &consulapi.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  time.Minute,
+		})
+		if err != nil {
+			log.Errorf("kvstore: consul watch failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		lastIndex = meta.LastIndex
+
+		nowSeen := make(map[string]uint64, len(pairs))
+
+		for _, pair := range pairs {
+			nowSeen[pair.Key] = pair.ModifyIndex
+
+			if oldIndex, ok := seen[pair.Key]; ok && oldIndex == pair.ModifyIndex {
+				continue
+			}
+
+			plain, err := open(ks.aead, pair.Value)
+			if err != nil {
+				log.Errorf("kvstore: failed to decrypt %s: %v", pair.Key, err)
+				continue
+			}
+
+			if strings.HasSuffix(pair.Key, kvDefaultMarkerKey) {
+				apply(setDefaultKeyEvent, plain)
+			} else {
+				apply(installKeyEvent, plain)
+			}
+		}
+
+		for key := range seen {
+			if _, ok := nowSeen[key]; !ok && !strings.HasSuffix(key, kvDefaultMarkerKey) {
+				if name, err := hex.DecodeString(strings.TrimPrefix(key, ks.prefix)); err == nil {
+					apply(removeKeyEvent, name)
+				}
+			}
+		}
+
+		seen = nowSeen
+	}
+}
+
+// acquire writes pair bound to ks.sessionID, so the session's delete-on-
+// expire behaviour reaps it if this proxy crashes. Unlike Put, Consul only
+// honours KVPair.Session - and so only grants delete-on-expire - through
+// Acquire.
+func (ks *consulKeyStore) acquire(pair *consulapi.KVPair) error {
+	pair.Session = ks.sessionID
+
+	ok, _, err := ks.cli.KV().Acquire(pair, nil)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("kvstore: failed to acquire %s under session %s", pair.Key, ks.sessionID)
+	}
+
+	return nil
+}
+
+func (ks *consulKeyStore) Mirror(ctx context.Context, event string, payload []byte) error {
+	switch event {
+	case installKeyEvent:
+		return ks.acquire(&consulapi.KVPair{
+			Key:   kvKeyName(ks.prefix, payload[:nameLen]),
+			Value: seal(ks.aead, payload),
+		})
+	case removeKeyEvent:
+		_, err := ks.cli.KV().Delete(kvKeyName(ks.prefix, payload), nil)
+		return err
+	case setDefaultKeyEvent:
+		return ks.acquire(&consulapi.KVPair{
+			Key:   ks.prefix + kvDefaultMarkerKey,
+			Value: seal(ks.aead, payload),
+		})
+	case wipeKeysEvent:
+		_, err := ks.cli.KV().DeleteTree(ks.prefix, nil)
+		return err
+	default:
+		return nil
+	}
+}
+
+func (ks *consulKeyStore) Close() error {
+	_, err := ks.cli.Session().Destroy(ks.sessionID, nil)
+	return err
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+	lsyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+// log is the package-wide structured logger. It stands in for the standard
+// library's log package - Printf, Println, and so on all still work - but
+// output is structured, leveled, and can be routed to syslog.
+var log = logrus.New()
+
+func init() {
+	log.SetFormatter(&logrus.JSONFormatter{})
+}
+
+// enableSyslog routes log output to the local syslog daemon instead of
+// stderr, for deployments that centralise logs via syslog rather than
+// scraping a process's stdout/stderr.
+func enableSyslog(tag string) error {
+	hook, err := lsyslog.NewSyslogHook("", "", syslog.LOG_INFO, tag)
+	if err != nil {
+		return err
+	}
+
+	log.AddHook(hook)
+	log.SetOutput(io.Discard)
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// buildVersion is overridden at build time with -ldflags "-X main.buildVersion=...".
+var buildVersion = "dev"
+
+var (
+	keysTotal = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ether_keys_total",
+		Help: "The number of keys currently held by this proxy.",
+	})
+
+	hasDefault = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ether_has_default",
+		Help: "1 if a default key is set, 0 otherwise.",
+	})
+
+	keyEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ether_key_events_total",
+		Help: "Key events processed by this proxy, labelled by event type and outcome.",
+	}, []string{"event", "outcome"})
+
+	retrieveKeysQueriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ether_retrieve_keys_queries_total",
+		Help: "The number of retrieve-keys queries this proxy has served.",
+	})
+
+	retrieveKeysKeysServedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ether_retrieve_keys_keys_served_total",
+		Help: "The total number of keys returned across all retrieve-keys query responses.",
+	})
+
+	serfRPCDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "ether_serf_rpc_duration_seconds",
+		Help: "Latency of serf RPC calls made by this proxy, labelled by RPC name.",
+	}, []string{"rpc"})
+
+	buildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ether_build_info",
+		Help: "A constant 1, labelled by the running build's version.",
+	}, []string{"version"})
+)
+
+func init() {
+	buildInfo.WithLabelValues(buildVersion).Set(1)
+}
+
+// observeSerfRPC runs fn, timing it into the ether_serf_rpc_duration_seconds
+// histogram under the given rpc label.
+func observeSerfRPC(rpc string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	serfRPCDuration.WithLabelValues(rpc).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// updateKeyGauges refreshes ether_keys_total and ether_has_default from the
+// current in-memory key state. The caller must hold keysMut.
+func updateKeyGauges() {
+	keysTotal.Set(float64(len(keys)))
+
+	if defaultKey != nil {
+		hasDefault.Set(1)
+	} else {
+		hasDefault.Set(0)
+	}
+}
+
+// serveMetrics serves the Prometheus metrics endpoint on addr until the
+// process exits.
+func serveMetrics(addr string) {
+	log.Errorf("metrics: server stopped: %v", http.ListenAndServe(addr, promhttp.Handler()))
+}
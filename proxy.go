@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
-	"log"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	msgpack "github.com/hashicorp/go-msgpack/codec"
 	serf "github.com/hashicorp/serf/client"
@@ -25,23 +28,165 @@ var defaultKey *[]byte
 var keys [][]byte
 var keysMut sync.RWMutex
 
+// eventOrigin distinguishes how a mutation reached processEvent, so it can
+// decide whether to trust the payload as-is and how far to propagate it.
+type eventOrigin int
+
+const (
+	originWAN eventOrigin = iota
+	originAdmin
+	originKV
+)
+
 func main() {
-	wanConf := &serf.Config{}
-	lanConf := &serf.Config{}
+	if hasBoolFlag(os.Args[1:], "normaliseconfig") {
+		if err := normaliseConfig(os.Stdin, os.Stdout); err != nil {
+			panic(err)
+		}
+
+		return
+	}
+
+	cfg := defaultConfig()
+
+	if configPath := configPathFromArgs(os.Args[1:]); configPath != "" {
+		var err error
+		if cfg, err = loadConfigFile(configPath); err != nil {
+			panic(err)
+		}
+	}
+
+	var configPath string
+	flag.StringVar(&configPath, "config", "", "a HJSON, JSON or YAML config file to load (flags take precedence)")
+
+	wanConf := &cfg.Wan
+	lanConf := &cfg.Lan
 
-	flag.StringVar(&wanConf.Addr, "wan-addr", "127.0.0.1:7374", "the address to connect to")
-	flag.StringVar(&wanConf.AuthKey, "wan-auth", "", "the RPC auth key")
-	flag.DurationVar(&wanConf.Timeout, "wan-timeout", 0, "the RPC timeout")
+	flag.StringVar(&wanConf.Addr, "wan-addr", wanConf.Addr, "the address to connect to")
+	flag.StringVar(&wanConf.AuthKey, "wan-auth", wanConf.AuthKey, "the RPC auth key")
+	flag.DurationVar(&wanConf.Timeout, "wan-timeout", wanConf.Timeout, "the RPC timeout")
 
-	flag.StringVar(&lanConf.Addr, "lan-addr", "127.0.0.1:7373", "the address to connect to")
-	flag.StringVar(&lanConf.AuthKey, "lan-auth", "", "the RPC auth key")
-	flag.DurationVar(&lanConf.Timeout, "lan-timeout", 0, "the RPC timeout")
+	flag.StringVar(&lanConf.Addr, "lan-addr", lanConf.Addr, "the address to connect to")
+	flag.StringVar(&lanConf.AuthKey, "lan-auth", lanConf.AuthKey, "the RPC auth key")
+	flag.DurationVar(&lanConf.Timeout, "lan-timeout", lanConf.Timeout, "the RPC timeout")
 
 	var eventKeyPrefix string
-	flag.StringVar(&eventKeyPrefix, "prefix", "ether:", "the serf event prefix")
+	flag.StringVar(&eventKeyPrefix, "prefix", cfg.Prefix, "the serf event prefix")
+
+	var stateDir string
+	flag.StringVar(&stateDir, "state-dir", cfg.StateDir, "the directory to persist key state to (disabled if empty)")
+
+	var kvBackend string
+	flag.StringVar(&kvBackend, "kv-backend", cfg.KVBackend, "a KV store to bootstrap and mirror keys to/from, e.g. etcd://127.0.0.1:2379 (disabled if empty)")
+
+	var kvPrefix string
+	flag.StringVar(&kvPrefix, "kv-prefix", cfg.KVPrefix, "the key prefix to use in the KV backend")
+
+	var kvSecret string
+	flag.StringVar(&kvSecret, "kv-secret", cfg.KVSecret, "an AES-128/192/256 key (as raw bytes) used to seal key material before writing it to the KV backend")
+
+	var eventHMACKey string
+	flag.StringVar(&eventHMACKey, "event-hmac-key", cfg.EventHMACKey, "a shared secret used to sign and verify event payloads, given directly (disabled if empty, and mutually exclusive with -event-hmac-key-file)")
+
+	var eventHMACKeyFile string
+	flag.StringVar(&eventHMACKeyFile, "event-hmac-key-file", cfg.EventHMACKeyFile, "a path to a \"KeyID:hexkey\" per-line key ring file used to sign and verify event payloads (disabled if empty, and mutually exclusive with -event-hmac-key)")
+
+	var eventHMACSkew time.Duration
+	flag.DurationVar(&eventHMACSkew, "event-hmac-skew", time.Duration(cfg.EventHMACSkew), "the maximum age of a signed event before it is rejected")
+
+	var eventHMACRequired bool
+	flag.BoolVar(&eventHMACRequired, "event-hmac-required", cfg.EventHMACRequired, "reject unsigned events instead of accepting them")
+
+	var adminAddr string
+	flag.StringVar(&adminAddr, "admin-addr", cfg.AdminAddr, "the address to serve the gRPC/HTTP admin API on (disabled if empty)")
+
+	var adminTokenFile string
+	flag.StringVar(&adminTokenFile, "admin-token-file", cfg.AdminTokenFile, "a file containing the bearer token required of admin API callers")
+
+	var adminTLSCert string
+	flag.StringVar(&adminTLSCert, "admin-tls-cert", cfg.AdminTLSCert, "a TLS certificate for the admin API (disabled if empty)")
+
+	var adminTLSKey string
+	flag.StringVar(&adminTLSKey, "admin-tls-key", cfg.AdminTLSKey, "the private key matching -admin-tls-cert")
+
+	var adminClientCA string
+	flag.StringVar(&adminClientCA, "admin-client-ca", cfg.AdminClientCA, "a CA bundle to require and verify admin API client certificates against, for mTLS (disabled if empty)")
+
+	var metricsAddr string
+	flag.StringVar(&metricsAddr, "metrics-addr", cfg.MetricsAddr, "the address to serve Prometheus metrics on (disabled if empty)")
+
+	var logSyslog bool
+	flag.BoolVar(&logSyslog, "log-syslog", cfg.LogSyslog, "send log output to syslog instead of stderr")
 
 	flag.Parse()
 
+	if logSyslog {
+		if err := enableSyslog(filepath.Base(os.Args[0])); err != nil {
+			panic(err)
+		}
+	}
+
+	if metricsAddr != "" {
+		go serveMetrics(metricsAddr)
+	}
+
+	var kvStore KeyStore
+	if kvBackend != "" {
+		var err error
+		if kvStore, err = newKeyStore(kvBackend, kvPrefix, []byte(kvSecret)); err != nil {
+			panic(err)
+		}
+	}
+
+	mirrorToKV := func(event string, payload []byte) {
+		if kvStore == nil {
+			return
+		}
+
+		if err := kvStore.Mirror(context.Background(), event, payload); err != nil {
+			log.Errorf("kvstore: failed to mirror %s: %v", event, err)
+		}
+	}
+
+	var eventAuth *eventAuthenticator
+	if eventHMACKey != "" || eventHMACKeyFile != "" {
+		var err error
+		if eventAuth, err = newEventAuthenticator(eventHMACKey, eventHMACKeyFile, eventHMACSkew, eventHMACRequired); err != nil {
+			panic(err)
+		}
+	}
+
+	var stateWAL *wal
+	if stateDir != "" {
+		if err := os.MkdirAll(stateDir, 0700); err != nil {
+			panic(err)
+		}
+
+		if err := loadState(stateDir); err != nil {
+			panic(err)
+		}
+
+		updateKeyGauges()
+
+		var err error
+		stateWAL, err = openWAL(filepath.Join(stateDir, walFileName))
+		if err != nil {
+			panic(err)
+		}
+
+		go runSnapshotter(stateDir, stateWAL, nil)
+	}
+
+	persistEvent := func(event string, payload []byte) {
+		if stateWAL == nil {
+			return
+		}
+
+		if err := stateWAL.Append(event, payload); err != nil {
+			panic(err)
+		}
+	}
+
 	wanRPC, err := serf.ClientFromConfig(wanConf)
 	if err != nil {
 		panic(err)
@@ -63,7 +208,9 @@ func main() {
 			}
 
 			keysMut.RLock()
-			log.Printf("%s%s: %d keys", eventKeyPrefix, retrieveKeysQuery, len(keys))
+			log.Infof("%s%s: %d keys", eventKeyPrefix, retrieveKeysQuery, len(keys))
+			retrieveKeysQueriesTotal.Inc()
+			retrieveKeysKeysServedTotal.Add(float64(len(keys)))
 
 			enc := msgpack.NewEncoderBytes(&buf, &msgpack.MsgpackHandle{RawToString: true, WriteExt: true})
 
@@ -88,7 +235,7 @@ func main() {
 				id = (uint64)(req["ID"].(int64))
 			}
 
-			if err := lanRPC.Respond(id, buf); err != nil {
+			if err := observeSerfRPC("respond", func() error { return lanRPC.Respond(id, buf) }); err != nil {
 				panic(err)
 			}
 			keysMut.RUnlock()
@@ -99,116 +246,195 @@ func main() {
 		panic(err)
 	}
 
-	userCh := make(chan map[string]interface{})
-
-	go func() {
-	evLoop:
-		for ev := range userCh {
-			name, ok0 := ev["Name"].(string)
-			payload, ok1 := ev["Payload"].([]byte)
-			coalesce, ok2 := ev["Coalesce"].(bool)
+	// processEvent applies a single install/remove/set-default/wipe event to
+	// local state and rebroadcasts it to the LAN. It is the single code path
+	// for a mutation regardless of where it came from, but origin still
+	// matters: only originWAN payloads need to pass eventAuth.Verify (the
+	// admin API and the KV watch already deal in trusted, unsigned bodies),
+	// and only originAdmin mutations are re-published to the WAN, since
+	// originWAN events are already propagating there via serf gossip and
+	// originKV events are already visible to every proxy through the KV
+	// backend itself.
+	processEvent := func(name string, payload []byte, coalesce bool, origin eventOrigin) {
+		if origin == originWAN && eventAuth != nil {
+			body, signed, verr := eventAuth.Verify(payload)
+			if verr != nil {
+				log.Warnf("%s: rejecting event: %v", name, verr)
+				return
+			}
 
-			if !ok0 || !ok1 || !ok2 {
-				panic("invalid event")
+			if !signed && eventAuth.required {
+				log.Warnf("%s: rejecting unsigned event (event-hmac-required)", name)
+				return
 			}
 
-			if name[:len(eventKeyPrefix)] != eventKeyPrefix {
-				continue
+			payload = body
+		}
+
+		outgoing := payload
+		if eventAuth != nil {
+			signedPayload, err := eventAuth.Sign(payload)
+			if err != nil {
+				panic(err)
 			}
 
-			if err = lanRPC.UserEvent(name, payload, coalesce); err != nil {
+			outgoing = signedPayload
+		}
+
+		if err := observeSerfRPC("lan_user_event", func() error { return lanRPC.UserEvent(name, outgoing, coalesce) }); err != nil {
+			panic(err)
+		}
+
+		if origin == originAdmin {
+			if err := observeSerfRPC("wan_user_event", func() error { return wanRPC.UserEvent(name, outgoing, coalesce) }); err != nil {
 				panic(err)
 			}
+		}
 
-			switch name[len(eventKeyPrefix):] {
-			case installKeyEvent:
-				if len(payload) <= nameLen {
-					panic("invalid event payload")
-				}
+		// mirror skips the KV backend when the event came from the KV
+		// backend's own watch, so a proxy doesn't re-write a value it just
+		// read back, which would otherwise retrigger its own watch forever.
+		mirror := mirrorToKV
+		if origin == originKV {
+			mirror = func(string, []byte) {}
+		}
 
-				log.Printf("%s %x", name, payload[:nameLen])
+		switch name[len(eventKeyPrefix):] {
+		case installKeyEvent:
+			if len(payload) <= nameLen {
+				keyEventsTotal.WithLabelValues("install", "invalid").Inc()
+				panic("invalid event payload")
+			}
 
-				keysMut.Lock()
-				for _, key := range keys {
-					if bytes.Equal(key[:nameLen], payload[:nameLen]) {
-						log.Printf("already have key %x", payload[:nameLen])
+			log.Infof("%s %x", name, payload[:nameLen])
 
-						keysMut.Unlock()
-						continue evLoop
-					}
-				}
+			keysMut.Lock()
+			for _, key := range keys {
+				if bytes.Equal(key[:nameLen], payload[:nameLen]) {
+					log.Warnf("already have key %x", payload[:nameLen])
+					keyEventsTotal.WithLabelValues("install", "duplicate").Inc()
 
-				keys = append(keys, payload)
-				keysMut.Unlock()
-			case removeKeyEvent:
-				if len(payload) != nameLen {
-					panic("invalid event payload")
+					keysMut.Unlock()
+					return
 				}
+			}
 
-				log.Printf("%s %x", name, payload[:nameLen])
+			persistEvent(installKeyEvent, payload)
+			mirror(installKeyEvent, payload)
+			keys = append(keys, payload)
+			keyEventsTotal.WithLabelValues("install", "applied").Inc()
+			updateKeyGauges()
+			keysMut.Unlock()
+			notifyAdmin(installKeyEvent, payload)
+		case removeKeyEvent:
+			if len(payload) != nameLen {
+				keyEventsTotal.WithLabelValues("remove", "invalid").Inc()
+				panic("invalid event payload")
+			}
 
-				keysMut.Lock()
-				for i, key := range keys {
-					if bytes.Equal(key[:nameLen], payload) {
-						// zero old key
-						for i := range key {
-							key[i] = 0
-						}
+			log.Infof("%s %x", name, payload[:nameLen])
 
-						keys[i] = keys[len(keys)-1]
-						keys[len(keys)-1] = nil
-						keys = keys[:len(keys)-1]
+			keysMut.Lock()
+			for i, key := range keys {
+				if bytes.Equal(key[:nameLen], payload) {
+					persistEvent(removeKeyEvent, payload)
+					mirror(removeKeyEvent, payload)
+					notifyAdmin(removeKeyEvent, payload)
 
-						keysMut.Unlock()
-						continue evLoop
+					// zero old key
+					for i := range key {
+						key[i] = 0
 					}
-				}
 
-				log.Printf("cannot remove key %x", payload[:nameLen])
-				keysMut.Unlock()
-			case setDefaultKeyEvent:
-				if len(payload) != nameLen {
-					panic("invalid event payload")
+					keys[i] = keys[len(keys)-1]
+					keys[len(keys)-1] = nil
+					keys = keys[:len(keys)-1]
+					keyEventsTotal.WithLabelValues("remove", "applied").Inc()
+					updateKeyGauges()
+
+					keysMut.Unlock()
+					return
 				}
+			}
 
-				log.Printf("%s %x", name, payload[:nameLen])
+			log.Warnf("cannot remove key %x", payload[:nameLen])
+			keyEventsTotal.WithLabelValues("remove", "invalid").Inc()
+			keysMut.Unlock()
+		case setDefaultKeyEvent:
+			if len(payload) != nameLen {
+				keyEventsTotal.WithLabelValues("set_default", "invalid").Inc()
+				panic("invalid event payload")
+			}
 
-				keysMut.Lock()
-				defaultKey = nil
+			log.Infof("%s %x", name, payload[:nameLen])
 
-				for _, key := range keys {
-					if bytes.Equal(key[:nameLen], payload) {
-						defaultKey = &key
-						break
-					}
-				}
+			keysMut.Lock()
+			persistEvent(setDefaultKeyEvent, payload)
+			mirror(setDefaultKeyEvent, payload)
+			notifyAdmin(setDefaultKeyEvent, payload)
+			defaultKey = nil
 
-				if defaultKey == nil {
-					log.Printf("cannot set default key %x", payload[:nameLen])
+			for _, key := range keys {
+				if bytes.Equal(key[:nameLen], payload) {
+					defaultKey = &key
+					break
 				}
+			}
 
-				keysMut.Unlock()
-			case wipeKeysEvent:
-				if len(payload) != 0 {
-					log.Printf("invalid %s event payload", eventKeyPrefix+wipeKeysEvent)
-				}
+			if defaultKey == nil {
+				log.Warnf("cannot set default key %x", payload[:nameLen])
+				keyEventsTotal.WithLabelValues("set_default", "invalid").Inc()
+			} else {
+				keyEventsTotal.WithLabelValues("set_default", "applied").Inc()
+			}
 
-				log.Println(name)
+			updateKeyGauges()
+			keysMut.Unlock()
+		case wipeKeysEvent:
+			if len(payload) != 0 {
+				log.Warnf("invalid %s event payload", eventKeyPrefix+wipeKeysEvent)
+				keyEventsTotal.WithLabelValues("wipe", "invalid").Inc()
+			}
 
-				keysMut.Lock()
-				for _, key := range keys {
-					// zero old key
-					for i := range key {
-						key[i] = 0
-					}
+			log.Info(name)
+
+			keysMut.Lock()
+			persistEvent(wipeKeysEvent, nil)
+			mirror(wipeKeysEvent, nil)
+			notifyAdmin(wipeKeysEvent, nil)
+
+			for _, key := range keys {
+				// zero old key
+				for i := range key {
+					key[i] = 0
 				}
+			}
+
+			defaultKey = nil
+			keys = nil
+			keyEventsTotal.WithLabelValues("wipe", "applied").Inc()
+			updateKeyGauges()
+			keysMut.Unlock()
+		}
+	}
+
+	userCh := make(chan map[string]interface{})
+
+	go func() {
+		for ev := range userCh {
+			name, ok0 := ev["Name"].(string)
+			payload, ok1 := ev["Payload"].([]byte)
+			coalesce, ok2 := ev["Coalesce"].(bool)
+
+			if !ok0 || !ok1 || !ok2 {
+				panic("invalid event")
+			}
 
-				defaultKey = nil
-				keys = nil
-				keysMut.Unlock()
-			default:
+			if name[:len(eventKeyPrefix)] != eventKeyPrefix {
 				continue
 			}
+
+			processEvent(name, payload, coalesce, originWAN)
 		}
 	}()
 
@@ -216,65 +442,111 @@ func main() {
 		panic(err)
 	}
 
-	respCh := make(chan serf.NodeResponse, 1)
+	if adminAddr != "" {
+		admin := newAdminServer(eventKeyPrefix, func(name string, payload []byte, coalesce bool) {
+			processEvent(name, payload, coalesce, originAdmin)
+		})
 
-	if err = wanRPC.Query(&serf.QueryParam{
-		RequestAck: false,
-		Name:       eventKeyPrefix + retrieveKeysQuery,
-		RespCh:     respCh,
-	}); err != nil {
-		panic(err)
+		go admin.Serve(adminAddr, adminTokenFile, adminTLSCert, adminTLSKey, adminClientCA)
 	}
 
-	log.Printf("Query '%s%s' dispatched", eventKeyPrefix, retrieveKeysQuery)
-
 	keysMut.Lock()
-	resp := <-respCh
+	haveLocalState := len(keys) > 0 || defaultKey != nil
+	keysMut.Unlock()
 
-	var mh msgpack.MsgpackHandle
-	dec := msgpack.NewDecoderBytes(resp.Payload, &mh)
+	if kvStore != nil {
+		if !haveLocalState {
+			snap, err := kvStore.LoadAll(context.Background())
+			if err != nil {
+				panic(err)
+			}
 
-	var body struct {
-		Default []byte
-		Keys    [][]byte
-	}
+			keysMut.Lock()
+			keys = snap.Keys
 
-	if err := dec.Decode(&body); err != nil {
-		panic(err)
-	}
+			if len(snap.Default) == nameLen {
+				for _, key := range keys {
+					if bytes.Equal(key[:nameLen], snap.Default) {
+						defaultKey = &key
+						break
+					}
+				}
+			}
 
-	keyNames := make([][nameLen]byte, len(body.Keys))
-	for i, key := range body.Keys {
-		copy(keyNames[i][:], key[:nameLen])
-	}
+			log.Infof("kvstore: loaded %d keys from %s", len(keys), kvPrefix)
+			updateKeyGauges()
+			keysMut.Unlock()
+		}
+
+		go kvStore.Watch(context.Background(), func(event string, payload []byte) {
+			processEvent(eventKeyPrefix+event, payload, false, originKV)
+		})
+	} else if haveLocalState {
+		log.Infof("skipping '%s%s' query, state already loaded from -state-dir", eventKeyPrefix, retrieveKeysQuery)
+	} else {
+		respCh := make(chan serf.NodeResponse, 1)
+
+		if err = observeSerfRPC("query", func() error {
+			return wanRPC.Query(&serf.QueryParam{
+				RequestAck: false,
+				Name:       eventKeyPrefix + retrieveKeysQuery,
+				RespCh:     respCh,
+			})
+		}); err != nil {
+			panic(err)
+		}
+
+		log.Infof("Query '%s%s' dispatched", eventKeyPrefix, retrieveKeysQuery)
+
+		keysMut.Lock()
+		resp := <-respCh
+
+		var mh msgpack.MsgpackHandle
+		dec := msgpack.NewDecoderBytes(resp.Payload, &mh)
+
+		var body struct {
+			Default []byte
+			Keys    [][]byte
+		}
 
-	log.Printf(`%s%s response from '%s':
+		if err := dec.Decode(&body); err != nil {
+			panic(err)
+		}
+
+		keyNames := make([][nameLen]byte, len(body.Keys))
+		for i, key := range body.Keys {
+			copy(keyNames[i][:], key[:nameLen])
+		}
+
+		log.Infof(`%s%s response from '%s':
 	Default: %x
 	Keys: %x
 	Total Keys: %d
 `, eventKeyPrefix, retrieveKeysQuery, resp.From, body.Default, keyNames, len(body.Keys))
 
-	switch len(body.Default) {
-	case nameLen:
-		defaultKey = nil
+		switch len(body.Default) {
+		case nameLen:
+			defaultKey = nil
+
+			for _, key := range body.Keys {
+				if bytes.Equal(key[:nameLen], body.Default) {
+					defaultKey = &key
+					break
+				}
+			}
 
-		for _, key := range body.Keys {
-			if bytes.Equal(key[:nameLen], body.Default) {
-				defaultKey = &key
-				break
+			if defaultKey == nil {
+				log.Warnf("cannot set default key %x", body.Default)
 			}
+		case 0:
+		default:
+			panic("invalid default key size")
 		}
 
-		if defaultKey == nil {
-			log.Printf("cannot set default key %x", body.Default)
-		}
-	case 0:
-	default:
-		panic("invalid default key size")
+		keys = body.Keys
+		updateKeyGauges()
+		keysMut.Unlock()
 	}
 
-	keys = body.Keys
-	keysMut.Unlock()
-
 	select {}
 }
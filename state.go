@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	msgpack "github.com/hashicorp/go-msgpack/codec"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.msgpack"
+
+	snapshotInterval = 5 * time.Minute
+)
+
+// walEntry is a single applied key-state mutation, as appended to the WAL.
+type walEntry struct {
+	Event   string
+	Payload []byte
+}
+
+// keySnapshot is the persisted (and query-response) shape of the key state.
+type keySnapshot struct {
+	Default []byte
+	Keys    [][]byte
+}
+
+// wal is a length-prefixed, CRC-checked append-only log of walEntry records.
+type wal struct {
+	mu   sync.Mutex
+	f    *os.File
+	path string
+}
+
+func openWAL(path string) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wal{f: f, path: path}, nil
+}
+
+// Append writes a single entry to the WAL, fsyncing before returning so a
+// crash immediately after Append cannot lose the event.
+func (w *wal) Append(event string, payload []byte) error {
+	var buf []byte
+	enc := msgpack.NewEncoderBytes(&buf, &msgpack.MsgpackHandle{RawToString: true, WriteExt: true})
+
+	if err := enc.Encode(walEntry{Event: event, Payload: payload}); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(buf)))
+	binary.LittleEndian.PutUint32(hdr[4:8], crc32.ChecksumIEEE(buf))
+
+	if _, err := w.f.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	if _, err := w.f.Write(buf); err != nil {
+		return err
+	}
+
+	return w.f.Sync()
+}
+
+// compactInto atomically replaces the on-disk snapshot at snapshotPath with
+// snap and discards every WAL entry now folded into it. The write and the
+// truncate are kept under a single w.mu critical section so an Append that
+// lands between them can never be silently dropped without ever having
+// been captured by the snapshot it's truncated against.
+func (w *wal) compactInto(snapshotPath string, snap keySnapshot) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := saveSnapshot(snapshotPath, snap); err != nil {
+		return err
+	}
+
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return w.f.Sync()
+}
+
+func (w *wal) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.f.Close()
+}
+
+// replayWAL reads every entry from path in order. A truncated final record
+// (the result of a crash mid-append) is logged and ignored rather than
+// treated as fatal.
+func replayWAL(path string) ([]walEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []walEntry
+
+	for {
+		var hdr [8]byte
+
+		if _, err := io.ReadFull(f, hdr[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Warnf("wal: truncated record header, stopping replay: %v", err)
+			break
+		}
+
+		size := binary.LittleEndian.Uint32(hdr[0:4])
+		wantCRC := binary.LittleEndian.Uint32(hdr[4:8])
+
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(f, buf); err != nil {
+			log.Warnf("wal: truncated record body, stopping replay: %v", err)
+			break
+		}
+
+		if crc := crc32.ChecksumIEEE(buf); crc != wantCRC {
+			log.Warnf("wal: corrupt record (crc mismatch), stopping replay")
+			break
+		}
+
+		var entry walEntry
+		dec := msgpack.NewDecoderBytes(buf, &msgpack.MsgpackHandle{RawToString: true, WriteExt: true})
+		if err := dec.Decode(&entry); err != nil {
+			log.Warnf("wal: corrupt record (decode failed), stopping replay: %v", err)
+			break
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// loadSnapshot reads the snapshot file at path, if one exists.
+func loadSnapshot(path string) (*keySnapshot, error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snap keySnapshot
+	dec := msgpack.NewDecoderBytes(buf, &msgpack.MsgpackHandle{RawToString: true, WriteExt: true})
+	if err := dec.Decode(&snap); err != nil {
+		return nil, err
+	}
+
+	return &snap, nil
+}
+
+// saveSnapshot writes snap to path atomically via a temp file plus rename.
+func saveSnapshot(path string, snap keySnapshot) error {
+	var buf []byte
+	enc := msgpack.NewEncoderBytes(&buf, &msgpack.MsgpackHandle{RawToString: true, WriteExt: true})
+
+	if err := enc.Encode(snap); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// applyKeyEvent applies a single install/remove/set-default/wipe mutation
+// to the in-memory key state. It mirrors the mutation logic of the
+// corresponding live WAN event in main, but never re-appends to the WAL,
+// re-broadcasts to the LAN, or mirrors to a KeyStore - callers that need
+// that do it themselves around the call. The caller must hold keysMut.
+func applyKeyEvent(event string, payload []byte) {
+	switch event {
+	case installKeyEvent:
+		if len(payload) <= nameLen {
+			log.Warnf("%s: invalid %s payload, skipping", event, installKeyEvent)
+			return
+		}
+
+		for _, key := range keys {
+			if bytes.Equal(key[:nameLen], payload[:nameLen]) {
+				return
+			}
+		}
+
+		keys = append(keys, payload)
+	case removeKeyEvent:
+		if len(payload) != nameLen {
+			log.Warnf("invalid %s payload, skipping", removeKeyEvent)
+			return
+		}
+
+		for i, key := range keys {
+			if bytes.Equal(key[:nameLen], payload) {
+				keys[i] = keys[len(keys)-1]
+				keys[len(keys)-1] = nil
+				keys = keys[:len(keys)-1]
+				return
+			}
+		}
+	case setDefaultKeyEvent:
+		if len(payload) != nameLen {
+			log.Warnf("invalid %s payload, skipping", setDefaultKeyEvent)
+			return
+		}
+
+		defaultKey = nil
+
+		for _, key := range keys {
+			if bytes.Equal(key[:nameLen], payload) {
+				defaultKey = &key
+				break
+			}
+		}
+	case wipeKeysEvent:
+		defaultKey = nil
+		keys = nil
+	default:
+		log.Warnf("unknown key event %q, skipping", event)
+	}
+}
+
+// loadState loads the newest snapshot (if any) under stateDir, then replays
+// the WAL suffix recorded since that snapshot on top of it. It must be
+// called before keysMut is used concurrently.
+func loadState(stateDir string) error {
+	snapPath := filepath.Join(stateDir, snapshotFileName)
+
+	snap, err := loadSnapshot(snapPath)
+	if err != nil {
+		return err
+	}
+
+	if snap != nil {
+		defaultKey = nil
+		keys = snap.Keys
+
+		for _, key := range keys {
+			if defaultKey == nil && len(snap.Default) == nameLen && bytes.Equal(key[:nameLen], snap.Default) {
+				defaultKey = &key
+			}
+		}
+
+		log.Infof("state: loaded snapshot with %d keys", len(keys))
+	}
+
+	entries, err := replayWAL(filepath.Join(stateDir, walFileName))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		applyKeyEvent(entry.Event, entry.Payload)
+	}
+
+	if len(entries) > 0 {
+		log.Infof("state: replayed %d wal entries", len(entries))
+	}
+
+	return nil
+}
+
+// runSnapshotter periodically compacts the WAL into a fresh snapshot until
+// stop is closed.
+func runSnapshotter(stateDir string, w *wal, stop <-chan struct{}) {
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := compactState(stateDir, w); err != nil {
+				log.Errorf("state: snapshot failed: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// compactState snapshots the current key state and truncates the WAL down
+// to it. keysMut is held for the whole operation, not just the copy: every
+// WAL Append happens with keysMut already held by its caller, so holding it
+// here too rules out an Append landing, unobserved, between the snapshot
+// and the truncate that follows it.
+func compactState(stateDir string, w *wal) error {
+	keysMut.Lock()
+	defer keysMut.Unlock()
+
+	snap := keySnapshot{Keys: make([][]byte, len(keys))}
+	for i, key := range keys {
+		snap.Keys[i] = append([]byte(nil), key...)
+	}
+
+	if defaultKey != nil {
+		snap.Default = append([]byte(nil), (*defaultKey)[:nameLen]...)
+	}
+
+	if err := w.compactInto(filepath.Join(stateDir, snapshotFileName), snap); err != nil {
+		return err
+	}
+
+	log.Infof("state: compacted snapshot with %d keys", len(snap.Keys))
+	return nil
+}
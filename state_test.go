@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWALAppendReplay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, walFileName)
+
+	w, err := openWAL(path)
+	if err != nil {
+		t.Fatalf("openWAL: %v", err)
+	}
+
+	want := []walEntry{
+		{Event: installKeyEvent, Payload: []byte("first")},
+		{Event: removeKeyEvent, Payload: []byte("second")},
+		{Event: wipeKeysEvent, Payload: nil},
+	}
+
+	for _, entry := range want {
+		if err := w.Append(entry.Event, entry.Payload); err != nil {
+			t.Fatalf("Append(%q): %v", entry.Event, err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	got, err := replayWAL(path)
+	if err != nil {
+		t.Fatalf("replayWAL: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayWAL = %+v, want %+v", got, want)
+	}
+}
+
+func TestReplayWALMissingFile(t *testing.T) {
+	entries, err := replayWAL(filepath.Join(t.TempDir(), "does-not-exist.log"))
+	if err != nil {
+		t.Fatalf("replayWAL: %v", err)
+	}
+
+	if entries != nil {
+		t.Fatalf("replayWAL = %+v, want nil", entries)
+	}
+}
+
+// TestReplayWALTruncatedRecord confirms a truncated final record (the
+// result of a crash mid-Append) is logged and ignored rather than treated
+// as fatal, with every complete record before it still returned.
+func TestReplayWALTruncatedRecord(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, walFileName)
+
+	w, err := openWAL(path)
+	if err != nil {
+		t.Fatalf("openWAL: %v", err)
+	}
+
+	if err := w.Append(installKeyEvent, []byte("complete")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], 100)
+	if _, err := f.Write(hdr[:]); err != nil {
+		t.Fatalf("write truncated header: %v", err)
+	}
+
+	if _, err := f.Write([]byte("short")); err != nil {
+		t.Fatalf("write truncated body: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	entries, err := replayWAL(path)
+	if err != nil {
+		t.Fatalf("replayWAL: %v", err)
+	}
+
+	want := []walEntry{{Event: installKeyEvent, Payload: []byte("complete")}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("replayWAL = %+v, want %+v", entries, want)
+	}
+}
+
+// TestReplayWALCorruptRecord confirms a record whose CRC no longer matches
+// its body stops replay at that point instead of returning bad data.
+func TestReplayWALCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, walFileName)
+
+	w, err := openWAL(path)
+	if err != nil {
+		t.Fatalf("openWAL: %v", err)
+	}
+
+	if err := w.Append(installKeyEvent, []byte("good")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	if err := w.Append(removeKeyEvent, []byte("corrupted")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	// Flip a byte inside the second record's body without updating its CRC.
+	size := binary.LittleEndian.Uint32(data[0:4])
+	secondBody := 8 + int(size) + 8
+	data[secondBody] ^= 0xff
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	entries, err := replayWAL(path)
+	if err != nil {
+		t.Fatalf("replayWAL: %v", err)
+	}
+
+	want := []walEntry{{Event: installKeyEvent, Payload: []byte("good")}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("replayWAL = %+v, want %+v", entries, want)
+	}
+}
+
+func TestSaveLoadSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), snapshotFileName)
+
+	want := keySnapshot{
+		Default: []byte("abcdefghijklmnop"),
+		Keys:    [][]byte{[]byte("abcdefghijklmnop"), []byte("1234567890123456")},
+	}
+
+	if err := saveSnapshot(path, want); err != nil {
+		t.Fatalf("saveSnapshot: %v", err)
+	}
+
+	got, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatalf("loadSnapshot: %v", err)
+	}
+
+	if got == nil || !reflect.DeepEqual(*got, want) {
+		t.Fatalf("loadSnapshot = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadSnapshotMissingFile(t *testing.T) {
+	snap, err := loadSnapshot(filepath.Join(t.TempDir(), "does-not-exist.msgpack"))
+	if err != nil {
+		t.Fatalf("loadSnapshot: %v", err)
+	}
+
+	if snap != nil {
+		t.Fatalf("loadSnapshot = %+v, want nil", snap)
+	}
+}
+
+// TestCompactIntoDiscardsAppendedEntries confirms compactInto writes the
+// given snapshot and truncates the WAL: an entry Appended before compaction
+// is no longer replayed afterwards, and the snapshot on disk holds exactly
+// what was passed in.
+func TestCompactIntoDiscardsAppendedEntries(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, walFileName)
+	snapPath := filepath.Join(dir, snapshotFileName)
+
+	w, err := openWAL(walPath)
+	if err != nil {
+		t.Fatalf("openWAL: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.Append(installKeyEvent, []byte("folded-into-snapshot")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	snap := keySnapshot{Keys: [][]byte{[]byte("folded-into-snapshot")}}
+	if err := w.compactInto(snapPath, snap); err != nil {
+		t.Fatalf("compactInto: %v", err)
+	}
+
+	entries, err := replayWAL(walPath)
+	if err != nil {
+		t.Fatalf("replayWAL: %v", err)
+	}
+
+	if len(entries) != 0 {
+		t.Fatalf("replayWAL after compaction = %+v, want empty", entries)
+	}
+
+	got, err := loadSnapshot(snapPath)
+	if err != nil {
+		t.Fatalf("loadSnapshot: %v", err)
+	}
+
+	if got == nil || !reflect.DeepEqual(*got, snap) {
+		t.Fatalf("loadSnapshot = %+v, want %+v", got, snap)
+	}
+}
+
+func TestWALHeaderChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, walFileName)
+
+	w, err := openWAL(path)
+	if err != nil {
+		t.Fatalf("openWAL: %v", err)
+	}
+
+	if err := w.Append(installKeyEvent, []byte("payload")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	var hdr [8]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+
+	size := binary.LittleEndian.Uint32(hdr[0:4])
+	wantCRC := binary.LittleEndian.Uint32(hdr[4:8])
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(f, buf); err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+
+	if got := crc32.ChecksumIEEE(buf); got != wantCRC {
+		t.Fatalf("crc = %d, want %d", got, wantCRC)
+	}
+}